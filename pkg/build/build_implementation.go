@@ -17,22 +17,19 @@ package build
 import (
 	"bufio"
 	"context"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"hash"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
-	gzip "github.com/klauspost/pgzip"
 	"go.opentelemetry.io/otel"
 
 	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
-	"github.com/chainguard-dev/go-apk/pkg/tarball"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
@@ -48,61 +45,146 @@ import (
 )
 
 // BuildTarball takes the fully populated working directory and saves it to
-// an OCI image layer tar.gz file.
-func (bc *Context) BuildTarball(ctx context.Context) (string, hash.Hash, hash.Hash, int64, error) {
+// one or more OCI image layer tar.gz files. When bc.o.LayerFormat is
+// LayerFormatEStargz each layer is written in eStargz format instead, so it
+// can be range-fetched by stargz-snapshotter without a full pull. When
+// bc.ic.Layering declares package groups, the rootfs is partitioned across
+// one tarball per group (in declared order, with an implicit "top" group
+// last) instead of a single layer, so images sharing a base produce
+// byte-identical lower layers; each group's tarball is hand-rolled from
+// bc.fs, and bc.o.TimestampPolicy controls what mtime each entry gets (see
+// options.TimestampPolicy). The single-layer default (no groups declared,
+// not eStargz) still delegates to tarball.WriteTar for the actual tar entries, the same
+// as every apko build has, since that is what applies the installed
+// package DB's per-file overrides (uid/gid, device nodes); it only honors
+// bc.o.SourceDateEpoch for mtimes, not the other TimestampPolicy modes.
+// bc.o.Compression selects gzip (the default), zstd, or no compression for
+// non-eStargz layers. Each returned LayerBlob carries the mediaType (and,
+// for eStargz, the TOC digest annotation) its format and compression
+// require.
+func (bc *Context) BuildTarball(ctx context.Context) ([]LayerBlob, error) {
 	ctx, span := otel.Tracer("apko").Start(ctx, "BuildTarball")
 	defer span.End()
 
-	var outfile *os.File
-	var err error
+	paths, err := sortedFSPaths(bc.fs)
+	if err != nil {
+		return nil, fmt.Errorf("walking build context: %w", err)
+	}
 
-	if bc.o.TarballPath != "" {
-		outfile, err = os.Create(bc.o.TarballPath)
-	} else {
-		outfile, err = os.Create(filepath.Join(bc.o.TempDir(), bc.o.TarballFileName()))
+	groups := bc.ic.Layering.Groups
+	if len(groups) == 0 {
+		outPath := bc.o.TarballPath
+		if outPath == "" {
+			outPath = filepath.Join(bc.o.TempDir(), bc.o.TarballFileName())
+		}
+		blob, err := bc.buildLayerFile(ctx, "", paths, outPath)
+		if err != nil {
+			return nil, err
+		}
+		return []LayerBlob{blob}, nil
 	}
+
+	installed, err := bc.apk.GetInstalled()
 	if err != nil {
-		return "", nil, nil, 0, fmt.Errorf("opening the build context tarball path failed: %w", err)
+		return nil, fmt.Errorf("getting installed packages: %w", err)
 	}
-	bc.o.TarballPath = outfile.Name()
-	defer outfile.Close()
+	names, fileGroup := resolveLayerGroups(installed, groups)
 
-	// we use a general override of 0,0 for all files, but the specific overrides, that come from the installed package DB, come later
-	tw, err := tarball.NewContext(
-		tarball.WithSourceDateEpoch(bc.o.SourceDateEpoch),
-	)
-	if err != nil {
-		return "", nil, nil, 0, fmt.Errorf("failed to construct tarball build context: %w", err)
+	byGroup := make(map[string][]string, len(names))
+	for _, p := range paths {
+		g := groupForPath(filepath.Join("/", p), fileGroup, groups)
+		byGroup[g] = append(byGroup[g], p)
+	}
+
+	base := strings.TrimSuffix(bc.o.TarballFileName(), ".tar.gz")
+	blobs := make([]LayerBlob, 0, len(names))
+	for _, groupName := range names {
+		groupPaths := byGroup[groupName]
+		if len(groupPaths) == 0 {
+			continue
+		}
+		outPath := filepath.Join(bc.o.TempDir(), fmt.Sprintf("%s-%s.tar.gz", base, groupName))
+		blob, err := bc.buildLayerFile(ctx, groupName, groupPaths, outPath)
+		if err != nil {
+			return nil, fmt.Errorf("building %q layer: %w", groupName, err)
+		}
+		blobs = append(blobs, blob)
 	}
+	return blobs, nil
+}
 
-	digest := sha256.New()
+// buildLayerFile writes paths (a subset of bc.fs) to a single layer file
+// at outPath, as eStargz when bc.o.LayerFormat says so and otherwise as a
+// tar compressed per bc.o.Compression, and returns the resulting
+// LayerBlob. For the ungrouped layer (group "") outside eStargz, paths is
+// not used: buildDefaultTarball writes the whole of bc.fs.
+func (bc *Context) buildLayerFile(ctx context.Context, group string, paths []string, outPath string) (LayerBlob, error) {
+	outfile, err := os.Create(outPath)
+	if err != nil {
+		return LayerBlob{}, fmt.Errorf("opening the build context tarball path failed: %w", err)
+	}
+	defer outfile.Close()
+	if group == "" {
+		bc.o.TarballPath = outfile.Name()
+	}
 
 	buf := bufio.NewWriterSize(outfile, 1<<22)
-	gzw := gzip.NewWriter(io.MultiWriter(digest, buf))
-
-	diffid := sha256.New()
 
-	if err := tw.WriteTar(ctx, io.MultiWriter(diffid, gzw), bc.fs); err != nil {
-		return "", nil, nil, 0, fmt.Errorf("failed to generate tarball for image: %w", err)
-	}
-	if err := gzw.Close(); err != nil {
-		return "", nil, nil, 0, fmt.Errorf("closing gzip writer: %w", err)
+	var diffid, digest hash.Hash
+	var annotations map[string]string
+	if bc.o.LayerFormat == LayerFormatEStargz {
+		var tocDigest string
+		diffid, digest, tocDigest, err = bc.buildEstargzTarball(ctx, paths, buf)
+		if err != nil {
+			return LayerBlob{}, fmt.Errorf("failed to generate eStargz tarball for image: %w", err)
+		}
+		annotations = map[string]string{
+			"containerd.io/snapshot/stargz/toc.digest": "sha256:" + tocDigest,
+		}
+	} else if group == "" {
+		diffid, digest, err = bc.buildDefaultTarball(ctx, buf)
+		if err != nil {
+			return LayerBlob{}, fmt.Errorf("failed to generate tarball for image: %w", err)
+		}
+	} else {
+		diffid, digest, err = bc.buildGroupTarball(ctx, paths, buf)
+		if err != nil {
+			return LayerBlob{}, fmt.Errorf("failed to generate tarball for image: %w", err)
+		}
 	}
 
 	if err := buf.Flush(); err != nil {
-		return "", nil, nil, 0, fmt.Errorf("flushing %s: %w", outfile.Name(), err)
+		return LayerBlob{}, fmt.Errorf("flushing %s: %w", outfile.Name(), err)
 	}
 
 	stat, err := outfile.Stat()
 	if err != nil {
-		return "", nil, nil, 0, fmt.Errorf("stat(%q): %w", outfile.Name(), err)
+		return LayerBlob{}, fmt.Errorf("stat(%q): %w", outfile.Name(), err)
+	}
+
+	mediaType, err := bc.layerMediaType()
+	if err != nil {
+		return LayerBlob{}, err
 	}
 
 	bc.Logger().Infof("built image layer tarball as %s", outfile.Name())
-	return outfile.Name(), diffid, digest, stat.Size(), nil
+	return LayerBlob{
+		Group:       group,
+		Path:        outfile.Name(),
+		DiffID:      diffid,
+		Digest:      digest,
+		Size:        stat.Size(),
+		MediaType:   mediaType,
+		Annotations: annotations,
+	}, nil
 }
 
-func (bc *Context) GenerateImageSBOM(ctx context.Context, arch types.Architecture, img oci.SignedImage) ([]types.SBOM, error) {
+// GenerateImageSBOM generates the SBOM(s) for a built image. layers holds
+// the descriptor for every layer in the image, and layerGroups the
+// LayerBlob.Group each one was built from (both in the same order
+// BuildTarball returned its blobs in); when the image has more than one
+// layer, the SBOM records which layer each installed package landed in. layerGroups is ignored when there is only one layer.
+func (bc *Context) GenerateImageSBOM(ctx context.Context, arch types.Architecture, img oci.SignedImage, layers []v1.Descriptor, layerGroups []string) ([]types.SBOM, error) {
 	ctx, span := otel.Tracer("apko").Start(ctx, "GenerateImageSBOM")
 	defer span.End()
 
@@ -123,11 +205,15 @@ func (bc *Context) GenerateImageSBOM(ctx context.Context, arch types.Architectur
 		return nil, fmt.Errorf("getting %s manifest: %w", arch, err)
 	}
 
-	if len(m.Layers) != 1 {
-		return nil, fmt.Errorf("unexpected layers in %s manifest: %d", arch, len(m.Layers))
+	if len(m.Layers) != len(layers) {
+		return nil, fmt.Errorf("unexpected layers in %s manifest: got %d, want %d", arch, len(m.Layers), len(layers))
 	}
 
-	if err := s.SetLayerDigest(ctx, m.Layers[0].Digest); err != nil {
+	// The SBOM's primary layer digest is still the topmost layer, for
+	// tooling that only understands a single-layer image; per-package
+	// layer membership below records the rest for multi-layer images.
+	s.Options.ImageInfo.Layers = layers
+	if err := s.SetLayerDigest(ctx, layers[len(layers)-1].Digest); err != nil {
 		return nil, fmt.Errorf("reading layer tar: %w", err)
 	}
 
@@ -139,6 +225,14 @@ func (bc *Context) GenerateImageSBOM(ctx context.Context, arch types.Architectur
 		return nil, fmt.Errorf("getting installed packages from sbom: %w", err)
 	}
 
+	if len(layers) > 1 {
+		installed, err := bc.apk.GetInstalled()
+		if err != nil {
+			return nil, fmt.Errorf("getting installed packages: %w", err)
+		}
+		s.Options.ImageInfo.PackageLayers = packageLayerRelationships(installed, bc.ic.Layering.Groups, layerGroups, layers)
+	}
+
 	// Get the image digest
 	h, err := img.Digest()
 	if err != nil {
@@ -148,16 +242,19 @@ func (bc *Context) GenerateImageSBOM(ctx context.Context, arch types.Architectur
 	s.Options.ImageInfo.ImageDigest = h.String()
 	s.Options.ImageInfo.Arch = arch
 
-	var sboms = make([]types.SBOM, 0)
+	var sboms = make([]types.SBOM, 0, len(bc.o.SBOMFormats))
 	files, err := s.Generate()
 	if err != nil {
 		return nil, fmt.Errorf("generating sbom: %w", err)
 	}
-	for _, f := range files {
+	if len(files) != len(bc.o.SBOMFormats) {
+		return nil, fmt.Errorf("generating sbom: got %d files for %d requested formats", len(files), len(bc.o.SBOMFormats))
+	}
+	for i, f := range files {
 		log.Printf("f = %s", f)
 		sboms = append(sboms, types.SBOM{
 			Path:   f,
-			Format: bc.o.SBOMFormats[0],
+			Format: bc.o.SBOMFormats[i],
 			Arch:   arch.String(),
 			Digest: h,
 		})
@@ -295,6 +392,21 @@ func newSBOM(fsys apkfs.FullFS, o options.Options, ic types.ImageConfiguration,
 	return s
 }
 
+// sbomExt returns the file extension s.Generate/s.GenerateIndex use for a
+// given SBOM format, so callers can locate the on-disk file for a
+// specific (arch, format) pair.
+func sbomExt(format string) string {
+	switch format {
+	case "spdx":
+		return "spdx.json"
+	case "cyclonedx":
+		return "cdx"
+	case "idb":
+		return "idb"
+	}
+	return ""
+}
+
 func (bc *Context) GenerateIndexSBOM(ctx context.Context, indexDigest name.Digest, imgs map[types.Architecture]oci.SignedImage) ([]types.SBOM, error) {
 	_, span := otel.Tracer("apko").Start(ctx, "GenerateIndexSBOM")
 	defer span.End()
@@ -318,15 +430,6 @@ func (bc *Context) GenerateIndexSBOM(ctx context.Context, indexDigest name.Diges
 	if bc.o.UseDockerMediaTypes {
 		s.Options.ImageInfo.IndexMediaType = ggcrtypes.DockerManifestList
 	}
-	var ext string
-	switch bc.o.SBOMFormats[0] {
-	case "spdx":
-		ext = "spdx.json"
-	case "cyclonedx":
-		ext = "cdx"
-	case "idb":
-		ext = "idb"
-	}
 
 	// Load the images data into the SBOM generator options
 	archs := make([]types.Architecture, 0, len(imgs))
@@ -336,37 +439,45 @@ func (bc *Context) GenerateIndexSBOM(ctx context.Context, indexDigest name.Diges
 	sort.Slice(archs, func(i, j int) bool {
 		return archs[i].String() < archs[j].String()
 	})
-	for _, arch := range archs {
-		i := imgs[arch]
-		sbomHash, err := khash.SHA256ForFile(filepath.Join(s.Options.OutputDir, fmt.Sprintf("sbom-%s.%s", arch.ToAPK(), ext)))
-		if err != nil {
-			return nil, fmt.Errorf("checksumming %s SBOM: %w", arch, err)
+
+	var sboms = make([]types.SBOM, 0, len(bc.o.SBOMFormats))
+	for _, format := range bc.o.SBOMFormats {
+		ext := sbomExt(format)
+
+		s.Options.Formats = []string{format}
+		s.Options.ImageInfo.Images = make([]soptions.ArchImageInfo, 0, len(archs))
+		for _, arch := range archs {
+			i := imgs[arch]
+			sbomHash, err := khash.SHA256ForFile(filepath.Join(s.Options.OutputDir, fmt.Sprintf("sbom-%s.%s", arch.ToAPK(), ext)))
+			if err != nil {
+				return nil, fmt.Errorf("checksumming %s %s SBOM: %w", arch, format, err)
+			}
+
+			d, err := i.Digest()
+			if err != nil {
+				return nil, fmt.Errorf("getting arch image digest: %w", err)
+			}
+
+			s.Options.ImageInfo.Images = append(
+				s.Options.ImageInfo.Images,
+				soptions.ArchImageInfo{
+					Digest:     d,
+					Arch:       arch,
+					SBOMDigest: sbomHash,
+				})
 		}
 
-		d, err := i.Digest()
+		files, err := s.GenerateIndex()
 		if err != nil {
-			return nil, fmt.Errorf("getting arch image digest: %w", err)
+			return nil, fmt.Errorf("generating %s index SBOM: %w", format, err)
 		}
-
-		s.Options.ImageInfo.Images = append(
-			s.Options.ImageInfo.Images,
-			soptions.ArchImageInfo{
-				Digest:     d,
-				Arch:       arch,
-				SBOMDigest: sbomHash,
+		for _, f := range files {
+			sboms = append(sboms, types.SBOM{
+				Path:   f,
+				Format: format,
+				Digest: h,
 			})
-	}
-	files, err := s.GenerateIndex()
-	if err != nil {
-		return nil, fmt.Errorf("generating index SBOM: %w", err)
-	}
-	var sboms = make([]types.SBOM, 0, len(files))
-	for _, f := range files {
-		sboms = append(sboms, types.SBOM{
-			Path:   f,
-			Format: bc.o.SBOMFormats[0],
-			Digest: h,
-		})
+		}
 	}
 	return sboms, nil
 }
@@ -0,0 +1,34 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import "testing"
+
+func TestSBOMExt(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"spdx", "spdx.json"},
+		{"cyclonedx", "cdx"},
+		{"idb", "idb"},
+		{"unknown", ""},
+	}
+	for _, tt := range tests {
+		if got := sbomExt(tt.format); got != tt.want {
+			t.Errorf("sbomExt(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	gzip "github.com/klauspost/pgzip"
+
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+
+	"chainguard.dev/apko/pkg/options"
+)
+
+// layerWriteCloser wraps w with the writer for bc.o.Compression. The
+// returned writer must be closed to flush its trailer into w. zstd uses a
+// fixed compression level and parallel encoding across all CPUs, with no
+// timestamps in its frame headers, so the resulting layer stays
+// byte-identical across repeated builds.
+func (bc *Context) layerWriteCloser(w io.Writer) (io.WriteCloser, error) {
+	if err := validateCompression(bc.o.Compression, bc.o.UseDockerMediaTypes); err != nil {
+		return nil, err
+	}
+
+	switch bc.o.Compression {
+	case options.CompressionZstd:
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.SpeedDefault),
+			zstd.WithEncoderConcurrency(runtime.GOMAXPROCS(0)),
+		)
+	case options.CompressionNone:
+		return nopWriteCloser{w}, nil
+	case options.CompressionGzip, "":
+		return gzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unknown layer compression %q", bc.o.Compression)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// validateCompression is the conflict check behind layerWriteCloser,
+// pulled out as a pure function so it can be unit tested without a
+// *Context: schema2 (Docker) manifests have no zstd layer mediaType, so
+// the combination is rejected up front instead of producing a layer no
+// Docker-media-type consumer can read.
+func validateCompression(compression options.Compression, useDockerMediaTypes bool) error {
+	if compression == options.CompressionZstd && useDockerMediaTypes {
+		return fmt.Errorf("zstd compression is not supported with Docker media types: schema2 has no zstd layer mediaType")
+	}
+	return nil
+}
+
+// layerMediaType returns the OCI (or Docker, per bc.o.UseDockerMediaTypes)
+// manifest media type for a layer written with bc.o.LayerFormat and
+// bc.o.Compression, so buildLayerFile's caller never has to rederive it
+// from the raw options. eStargz layers are always gzip-framed regardless
+// of bc.o.Compression, so LayerFormat is checked first.
+func (bc *Context) layerMediaType() (ggcrtypes.MediaType, error) {
+	if bc.o.LayerFormat == LayerFormatEStargz {
+		if bc.o.UseDockerMediaTypes {
+			return ggcrtypes.DockerLayer, nil
+		}
+		return ggcrtypes.OCILayer, nil
+	}
+
+	switch bc.o.Compression {
+	case options.CompressionZstd:
+		return ggcrtypes.OCILayerZStd, nil
+	case options.CompressionNone:
+		if bc.o.UseDockerMediaTypes {
+			return ggcrtypes.DockerUncompressedLayer, nil
+		}
+		return ggcrtypes.OCIUncompressedLayer, nil
+	case options.CompressionGzip, "":
+		if bc.o.UseDockerMediaTypes {
+			return ggcrtypes.DockerLayer, nil
+		}
+		return ggcrtypes.OCILayer, nil
+	default:
+		return "", fmt.Errorf("unknown layer compression %q", bc.o.Compression)
+	}
+}
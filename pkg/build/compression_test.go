@@ -0,0 +1,43 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestValidateCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression options.Compression
+		docker      bool
+		wantErr     bool
+	}{
+		{"zstd with OCI media types is fine", options.CompressionZstd, false, false},
+		{"zstd with Docker media types is rejected", options.CompressionZstd, true, true},
+		{"gzip with Docker media types is fine", options.CompressionGzip, true, false},
+		{"none with Docker media types is fine", options.CompressionNone, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCompression(tt.compression, tt.docker)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateCompression(%v, %v) = %v, wantErr %v", tt.compression, tt.docker, err, tt.wantErr)
+			}
+		})
+	}
+}
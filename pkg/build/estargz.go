@@ -0,0 +1,319 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"sort"
+
+	apkfs "github.com/chainguard-dev/go-apk/pkg/fs"
+)
+
+// LayerFormatEStargz selects options.Options.LayerFormat to produce an
+// eStargz-compatible layer (see buildEstargzTarball) instead of a plain
+// gzip tarball. buildLayerFile attaches the resulting LayerBlob's mediaType
+// and containerd.io/snapshot/stargz/toc.digest annotation automatically.
+const LayerFormatEStargz = "estargz"
+
+// estargzFooterSize is the fixed size, in bytes, of the trailing gzip member
+// that every eStargz layer ends with. Consumers (e.g. stargz-snapshotter)
+// seek to (layer size - estargzFooterSize) to find it without downloading
+// the rest of the layer, so writeEstargzFooter refuses to write a member of
+// any other size.
+const estargzFooterSize = 36
+
+// estargzTOCEntry describes a single file or directory within an eStargz
+// layer's table of contents. The offset lets a range-fetching client pull
+// just the gzip member that contains this entry's content.
+//
+// Extended attributes are not captured yet: bc.fs (apkfs.FullFS) has no
+// xattr accessor to read them from, so a field that always marshaled empty
+// would just be a silent lie about coverage.
+type estargzTOCEntry struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size,omitempty"`
+	Mode    int64  `json:"mode"`
+	ModTime int64  `json:"modtime"`
+	Offset  int64  `json:"offset"`
+}
+
+// estargzTOC is the `stargz.index.json` trailer written after the file
+// entries and before the footer.
+type estargzTOC struct {
+	Version int               `json:"version"`
+	Entries []estargzTOCEntry `json:"entries"`
+}
+
+// buildEstargzTarball writes the given subset of bc.fs to w as an
+// eStargz-format layer: every tar entry is compressed as its own gzip
+// member so a client can range-fetch an individual file, followed by a
+// gzip-compressed TOC member and a fixed-size footer member that records
+// the TOC's offset. It returns the diffID (sha256 of the uncompressed tar
+// stream), the layer digest (sha256 of the compressed stream, footer
+// included), and the hex-encoded sha256 of the TOC JSON, which the caller
+// must attach to the layer descriptor as the
+// containerd.io/snapshot/stargz/toc.digest annotation.
+func (bc *Context) buildEstargzTarball(ctx context.Context, paths []string, w io.Writer) (hash.Hash, hash.Hash, string, error) {
+	digest := sha256.New()
+	diffid := sha256.New()
+
+	modTimes, err := bc.fileModTimes()
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("reading installed-package mtimes: %w", err)
+	}
+
+	cw := &countingWriter{w: io.MultiWriter(digest, w)}
+
+	inputs := make([]estargzInput, 0, len(paths))
+	for _, p := range paths {
+		info, err := bc.fs.Stat(p)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("stat(%q): %w", p, err)
+		}
+
+		var linkname string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if linkname, err = bc.fs.Readlink(p); err != nil {
+				return nil, nil, "", fmt.Errorf("reading symlink target for %q: %w", p, err)
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, linkname)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("building tar header for %q: %w", p, err)
+		}
+		hdr.Name = p
+		hdr.ModTime = bc.resolveModTime(p, modTimes)
+
+		in := estargzInput{Header: hdr}
+		if !info.IsDir() && info.Mode().IsRegular() {
+			in.Open = func() (io.ReadCloser, error) { return bc.fs.Open(p) }
+		}
+		inputs = append(inputs, in)
+	}
+
+	toc := estargzTOC{Version: 1}
+	toc.Entries, err = writeEstargzEntries(cw, diffid, inputs)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	tocJSON, err := json.Marshal(toc)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("marshaling stargz TOC: %w", err)
+	}
+	tocDigest := sha256.Sum256(tocJSON)
+
+	tocOffset := cw.n
+	gzw, _ := gzip.NewWriterLevel(cw, gzip.BestCompression)
+	gzw.Comment = "stargz.index.json"
+	if _, err := gzw.Write(tocJSON); err != nil {
+		return nil, nil, "", fmt.Errorf("writing stargz TOC: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, nil, "", fmt.Errorf("closing stargz TOC member: %w", err)
+	}
+
+	if err := writeEstargzFooter(cw, tocOffset); err != nil {
+		return nil, nil, "", fmt.Errorf("writing stargz footer: %w", err)
+	}
+
+	tocDigestHex := fmt.Sprintf("%x", tocDigest)
+	bc.Logger().Infof("eStargz TOC digest: sha256:%s", tocDigestHex)
+
+	return diffid, digest, tocDigestHex, nil
+}
+
+// estargzInput is one tar entry for writeEstargzEntries to write, decoupled
+// from bc.fs/*Context so the gzip-per-entry framing at the heart of
+// buildEstargzTarball can be exercised by a real archive/tar reader without
+// either. Open is nil for directories, symlinks, and anything else with no
+// content to stream; when set, it is called and closed once, the same way
+// buildEstargzTarball opens bc.fs.
+type estargzInput struct {
+	Header *tar.Header
+	Open   func() (io.ReadCloser, error)
+}
+
+// writeEstargzEntries is the pure core of buildEstargzTarball: it writes
+// each input as its own tar entry, framed in its own gzip member so a
+// client can range-fetch an individual file's content, and returns the TOC
+// entries describing them. Before it returns, the tar.Writer and every
+// gzip member, the last one included, are closed; cw keeps counting, so the
+// caller can record the offset of whatever it appends next.
+//
+// A single tar.Writer spans every input: archive/tar.Writer.Close writes
+// the two zero blocks that mark end-of-archive, so opening and closing a
+// fresh one per entry would bury every file but the first under its own
+// premature end-of-archive marker. Instead each entry gets its own gzip
+// member by redirecting the tar writer's output between members, and the
+// tar writer itself is only closed once, at the very end, into the final
+// entry's member.
+func writeEstargzEntries(cw *countingWriter, diffid io.Writer, inputs []estargzInput) ([]estargzTOCEntry, error) {
+	redirect := &redirectWriter{}
+	tw := tar.NewWriter(redirect)
+
+	var entries []estargzTOCEntry
+	var gzw *gzip.Writer
+	for i, in := range inputs {
+		offset := cw.n
+		gzw, _ = gzip.NewWriterLevel(cw, gzip.BestCompression)
+		redirect.w = io.MultiWriter(gzw, diffid)
+
+		if err := tw.WriteHeader(in.Header); err != nil {
+			return nil, fmt.Errorf("writing tar header for %q: %w", in.Header.Name, err)
+		}
+		if in.Open != nil {
+			f, err := in.Open()
+			if err != nil {
+				return nil, fmt.Errorf("opening %q: %w", in.Header.Name, err)
+			}
+			_, copyErr := io.Copy(tw, f)
+			f.Close()
+			if copyErr != nil {
+				return nil, fmt.Errorf("copying %q into layer: %w", in.Header.Name, copyErr)
+			}
+		}
+
+		// The last entry's member also carries the tar end-of-archive
+		// trailer, written via tw.Close() below, so only entries before
+		// it get closed here.
+		if i < len(inputs)-1 {
+			if err := tw.Flush(); err != nil {
+				return nil, fmt.Errorf("flushing tar entry for %q: %w", in.Header.Name, err)
+			}
+			if err := gzw.Close(); err != nil {
+				return nil, fmt.Errorf("closing gzip member for %q: %w", in.Header.Name, err)
+			}
+		}
+
+		entries = append(entries, estargzTOCEntry{
+			Name:    in.Header.Name,
+			Type:    entryType(in.Header),
+			Size:    in.Header.Size,
+			Mode:    int64(in.Header.Mode),
+			ModTime: in.Header.ModTime.Unix(),
+			Offset:  offset,
+		})
+	}
+
+	if len(inputs) == 0 {
+		gzw, _ = gzip.NewWriterLevel(cw, gzip.BestCompression)
+		redirect.w = io.MultiWriter(gzw, diffid)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("closing tar writer: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, fmt.Errorf("closing final gzip member: %w", err)
+	}
+
+	return entries, nil
+}
+
+// writeEstargzFooter writes a gzip member whose (uncompressed) payload is
+// the 8-byte big-endian offset of the TOC member. The member is built
+// uncompressed with no name, comment, or extra fields, which makes its
+// on-disk size a deterministic function of the 8-byte payload alone; it is
+// asserted against estargzFooterSize rather than trusted, so a change to
+// this encoding trips a build failure instead of silently shipping a layer
+// consumers seek into at the wrong offset.
+func writeEstargzFooter(w io.Writer, tocOffset int64) error {
+	payload := make([]byte, 8)
+	for i := 7; i >= 0; i-- {
+		payload[i] = byte(tocOffset)
+		tocOffset >>= 8
+	}
+
+	var buf bytes.Buffer
+	gzw, _ := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	if _, err := gzw.Write(payload); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+	if buf.Len() != estargzFooterSize {
+		return fmt.Errorf("internal error: stargz footer is %d bytes, want %d", buf.Len(), estargzFooterSize)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// redirectWriter forwards Writes to whatever writer w currently points at,
+// letting a single tar.Writer span multiple gzip members without ever being
+// bound to one of them directly.
+type redirectWriter struct {
+	w io.Writer
+}
+
+func (r *redirectWriter) Write(p []byte) (int, error) {
+	return r.w.Write(p)
+}
+
+// countingWriter tracks the number of bytes written so far, which is how
+// buildEstargzTarball records the starting offset of each gzip member.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func entryType(hdr *tar.Header) string {
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	default:
+		return "reg"
+	}
+}
+
+// sortedFSPaths returns every path in fsys in a stable, deterministic
+// order so that repeated builds produce byte-identical layers.
+func sortedFSPaths(fsys apkfs.FullFS) ([]string, error) {
+	var paths []string
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+		paths = append(paths, p)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
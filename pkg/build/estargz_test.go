@@ -0,0 +1,132 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestWriteEstargzFooterSize(t *testing.T) {
+	for _, offset := range []int64{0, 1, 1 << 20, 1 << 40} {
+		var buf bytes.Buffer
+		if err := writeEstargzFooter(&buf, offset); err != nil {
+			t.Fatalf("writeEstargzFooter(%d): %v", offset, err)
+		}
+		if buf.Len() != estargzFooterSize {
+			t.Fatalf("writeEstargzFooter(%d) wrote %d bytes, want %d", offset, buf.Len(), estargzFooterSize)
+		}
+	}
+}
+
+func TestWriteEstargzFooterRoundTrip(t *testing.T) {
+	const want int64 = 123456789
+	var buf bytes.Buffer
+	if err := writeEstargzFooter(&buf, want); err != nil {
+		t.Fatalf("writeEstargzFooter: %v", err)
+	}
+
+	gzr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	payload, err := io.ReadAll(gzr)
+	if err != nil {
+		t.Fatalf("reading footer payload: %v", err)
+	}
+	if len(payload) != 8 {
+		t.Fatalf("footer payload is %d bytes, want 8", len(payload))
+	}
+	if got := int64(binary.BigEndian.Uint64(payload)); got != want {
+		t.Fatalf("footer payload decoded to %d, want %d", got, want)
+	}
+}
+
+// TestWriteEstargzEntriesMultiFile guards against the regression
+// buildEstargzTarball originally shipped with: opening and closing a fresh
+// tar.Writer per entry, which buries every file but the first under its own
+// premature end-of-archive marker. A real archive/tar.Reader reading back
+// the gzip-per-entry output (gzip.Reader transparently concatenates the
+// members, same as a range-unaware client doing a full pull) must be able
+// to walk every entry with its content intact.
+func TestWriteEstargzEntriesMultiFile(t *testing.T) {
+	want := map[string]string{
+		"a.txt": "first file",
+		"b.txt": "second file, written after the bug would have corrupted the archive",
+		"c.txt": "third file",
+	}
+
+	inputs := make([]estargzInput, 0, len(want))
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		content := want[name]
+		inputs = append(inputs, estargzInput{
+			Header: &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Size:     int64(len(content)),
+				Mode:     0o644,
+			},
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader([]byte(content))), nil
+			},
+		})
+	}
+
+	var out bytes.Buffer
+	diffid := sha256.New()
+	entries, err := writeEstargzEntries(&countingWriter{w: &out}, diffid, inputs)
+	if err != nil {
+		t.Fatalf("writeEstargzEntries: %v", err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d TOC entries, want %d", len(entries), len(want))
+	}
+
+	gzr, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	tr := tar.NewReader(gzr)
+
+	got := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Reader.Next: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading %q: %v", hdr.Name, err)
+		}
+		got[hdr.Name] = string(content)
+	}
+
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("entry %q = %q, want %q", name, got[name], content)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("read back %d entries, want %d: %v", len(got), len(want), got)
+	}
+}
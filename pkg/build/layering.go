@@ -0,0 +1,144 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	chainguardAPK "chainguard.dev/apko/pkg/apk"
+	"chainguard.dev/apko/pkg/build/types"
+	soptions "chainguard.dev/apko/pkg/sbom/options"
+)
+
+// topLayerGroupName is the implicit final layer group that collects every
+// installed file not claimed by an entry in bc.ic.Layering.Groups. It is
+// always emitted last so base/runtime groups stay stable as the
+// application layer on top changes.
+const topLayerGroupName = "top"
+
+// resolveLayerGroups returns the layer group names in emit order (the
+// configured groups in declaration order, then the implicit "top" group)
+// and a map from the absolute path of every file of an installed package
+// claimed by a group's Packages to that group; when several groups list
+// the same package, the first declared one claims it. Path globs and the
+// "top" fallback for unclaimed files are not applied here but by
+// groupForPath, which consults this map first.
+func resolveLayerGroups(installed []*chainguardAPK.InstalledPackage, groups []types.LayerGroup) (names []string, fileGroup map[string]string) {
+	for _, g := range groups {
+		names = append(names, g.Name)
+	}
+	names = append(names, topLayerGroupName)
+
+	pkgGroup := make(map[string]string, len(groups))
+	for _, g := range groups {
+		for _, pkg := range g.Packages {
+			if _, claimed := pkgGroup[pkg]; !claimed {
+				pkgGroup[pkg] = g.Name
+			}
+		}
+	}
+
+	fileGroup = map[string]string{}
+	for _, pkg := range installed {
+		group, ok := pkgGroup[pkg.Name]
+		if !ok {
+			continue
+		}
+		for _, f := range pkg.Files {
+			fileGroup[filepath.Join("/", f.Name)] = group
+		}
+	}
+
+	return names, fileGroup
+}
+
+// packageLayerRelationships reports which installed packages ended up in
+// each non-empty layer group, for the SBOM's SPDX Relationships between a
+// package and the layer descriptor that contains it. layerGroups and
+// layers are the same two parallel slices BuildTarball produced its blobs
+// from (LayerBlob.Group and its descriptor, in order), so there is no
+// separate re-derivation of which groups turned out non-empty to get out
+// of sync with layers.
+func packageLayerRelationships(installed []*chainguardAPK.InstalledPackage, groups []types.LayerGroup, layerGroups []string, layers []v1.Descriptor) []soptions.PackageLayerRelationship {
+	_, fileGroup := resolveLayerGroups(installed, groups)
+
+	layerForGroup := make(map[string]v1.Descriptor, len(layerGroups))
+	for i, name := range layerGroups {
+		if i < len(layers) {
+			layerForGroup[name] = layers[i]
+		}
+	}
+
+	var rels []soptions.PackageLayerRelationship
+	for _, pkg := range installed {
+		files := make([]string, len(pkg.Files))
+		for i, f := range pkg.Files {
+			files[i] = f.Name
+		}
+		for _, group := range layerGroupsForFiles(files, fileGroup, groups) {
+			layer, ok := layerForGroup[group]
+			if !ok {
+				continue
+			}
+			rels = append(rels, soptions.PackageLayerRelationship{
+				Package: pkg.Name,
+				Layer:   layer,
+			})
+		}
+	}
+	return rels
+}
+
+// layerGroupsForFiles returns the distinct layer groups a package's files
+// resolve to, in first-encountered order, using the same resolution
+// groupForPath uses for BuildTarball: explicit package membership first,
+// then the first path glob that matches, else the implicit "top" group.
+// A package's files can land in more than one group this way (e.g. most of
+// a package claimed by its own group, with one file elsewhere matched by a
+// different group's path glob), which is why packageLayerRelationships
+// must not stop at the first file's group. Pulled out as a pure function,
+// decoupled from chainguardAPK.InstalledPackage, so that's unit testable.
+func layerGroupsForFiles(files []string, fileGroup map[string]string, groups []types.LayerGroup) []string {
+	var result []string
+	seen := make(map[string]bool, 1)
+	for _, f := range files {
+		group := groupForPath(filepath.Join("/", f), fileGroup, groups)
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		result = append(result, group)
+	}
+	return result
+}
+
+// groupForPath returns the layer group a path belongs to: the group that
+// owns the installed package providing it, else the first group whose
+// path glob matches, else the implicit "top" group.
+func groupForPath(path string, fileGroup map[string]string, groups []types.LayerGroup) string {
+	if g, ok := fileGroup[path]; ok {
+		return g
+	}
+	for _, g := range groups {
+		for _, glob := range g.Paths {
+			if ok, _ := filepath.Match(glob, path); ok {
+				return g.Name
+			}
+		}
+	}
+	return topLayerGroupName
+}
@@ -0,0 +1,89 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+func TestGroupForPath(t *testing.T) {
+	groups := []types.LayerGroup{
+		{Name: "base", Packages: []string{"alpine-baselayout"}},
+		{Name: "runtime", Paths: []string{"/usr/lib/*.so*"}},
+	}
+	fileGroup := map[string]string{
+		"/etc/os-release": "base",
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"explicit package file", "/etc/os-release", "base"},
+		{"path glob match", "/usr/lib/libc.so.1", "runtime"},
+		{"unclaimed falls to top", "/home/app/main", topLayerGroupName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := groupForPath(tt.path, fileGroup, groups); got != tt.want {
+				t.Errorf("groupForPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLayerGroupsForFiles(t *testing.T) {
+	groups := []types.LayerGroup{
+		{Name: "base", Packages: []string{"alpine-baselayout"}},
+		{Name: "runtime", Paths: []string{"/usr/lib/*.so*"}},
+	}
+	fileGroup := map[string]string{
+		"/etc/os-release": "base",
+	}
+
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{"single file, single group", []string{"/etc/os-release"}, []string{"base"}},
+		{
+			"package split across a glob-matched group and top",
+			[]string{"/usr/lib/libfoo.so.1", "/usr/bin/foo"},
+			[]string{"runtime", topLayerGroupName},
+		},
+		{
+			"duplicate group collapses to one entry",
+			[]string{"/usr/lib/libfoo.so.1", "/usr/lib/libbar.so.2"},
+			[]string{"runtime"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := layerGroupsForFiles(tt.files, fileGroup, groups)
+			if len(got) != len(tt.want) {
+				t.Fatalf("layerGroupsForFiles(%v) = %v, want %v", tt.files, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("layerGroupsForFiles(%v)[%d] = %q, want %q", tt.files, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
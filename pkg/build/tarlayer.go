@@ -0,0 +1,157 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+
+	"github.com/chainguard-dev/go-apk/pkg/tarball"
+	ggcrtypes "github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// LayerBlob is one tar.gz written by BuildTarball: either the image's sole
+// layer, or one of the per-group layers produced when bc.ic.Layering
+// declares any groups.
+type LayerBlob struct {
+	// Group is the layering group name this layer was built from, or ""
+	// when layering is not configured and the image has a single layer.
+	Group string
+	Path  string
+
+	DiffID hash.Hash
+	Digest hash.Hash
+	Size   int64
+
+	// MediaType is the OCI media type the manifest must record for this
+	// layer, reflecting bc.o.LayerFormat/bc.o.Compression (e.g. gzip,
+	// which eStargz layers also use, zstd, or uncompressed).
+	MediaType ggcrtypes.MediaType
+	// Annotations holds any descriptor annotations this layer format
+	// requires, such as eStargz's TOC digest annotation. Nil when the
+	// layer format doesn't need any.
+	Annotations map[string]string
+}
+
+// buildDefaultTarball writes the whole of bc.fs to w as a tar compressed
+// per bc.o.Compression (gzip by default), and returns its diffID (sha256
+// of the uncompressed tar stream) and digest (sha256 of the compressed
+// stream). This is the single-layer path used whenever bc.ic.Layering
+// declares no groups, and it delegates the actual tar entries to
+// tarball.WriteTar rather than hand-rolling headers off raw fs.FileInfo:
+// the installed-package DB carries per-file overrides (uid/gid, and
+// device-node major/minor for the /dev/* entries installCharDevices
+// writes) that only tarball.WriteTar applies. Per-group and eStargz layers
+// are written by buildGroupTarball and buildEstargzTarball instead, which
+// do not apply those overrides.
+func (bc *Context) buildDefaultTarball(ctx context.Context, w io.Writer) (hash.Hash, hash.Hash, error) {
+	digest := sha256.New()
+	diffid := sha256.New()
+
+	tw, err := tarball.NewContext(
+		tarball.WithSourceDateEpoch(bc.o.SourceDateEpoch),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to construct tarball build context: %w", err)
+	}
+
+	cw, err := bc.layerWriteCloser(io.MultiWriter(digest, w))
+	if err != nil {
+		return nil, nil, fmt.Errorf("constructing layer compressor: %w", err)
+	}
+
+	if err := tw.WriteTar(ctx, io.MultiWriter(diffid, cw), bc.fs); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate tarball for image: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("closing layer compressor: %w", err)
+	}
+
+	return diffid, digest, nil
+}
+
+// buildGroupTarball writes the given subset of bc.fs to w as a tar
+// compressed per bc.o.Compression (gzip by default), and returns its
+// diffID (sha256 of the uncompressed tar stream) and digest (sha256 of
+// the compressed stream). Unlike buildDefaultTarball, this hand-rolls tar
+// headers from fs.Stat instead of going through tarball.WriteTar, because
+// tarball.WriteTar has no way to restrict itself to a path subset; it
+// exists only to serve bc.ic.Layering's per-group tarballs, which
+// buildDefaultTarball's whole-fs write can't produce.
+func (bc *Context) buildGroupTarball(ctx context.Context, paths []string, w io.Writer) (hash.Hash, hash.Hash, error) {
+	digest := sha256.New()
+	diffid := sha256.New()
+
+	modTimes, err := bc.fileModTimes()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading installed-package mtimes: %w", err)
+	}
+
+	cw, err := bc.layerWriteCloser(io.MultiWriter(digest, w))
+	if err != nil {
+		return nil, nil, fmt.Errorf("constructing layer compressor: %w", err)
+	}
+	tw := tar.NewWriter(io.MultiWriter(diffid, cw))
+
+	for _, p := range paths {
+		info, err := bc.fs.Stat(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("stat(%q): %w", p, err)
+		}
+
+		var linkname string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if linkname, err = bc.fs.Readlink(p); err != nil {
+				return nil, nil, fmt.Errorf("reading symlink target for %q: %w", p, err)
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, linkname)
+		if err != nil {
+			return nil, nil, fmt.Errorf("building tar header for %q: %w", p, err)
+		}
+		hdr.Name = p
+		hdr.ModTime = bc.resolveModTime(p, modTimes)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, nil, fmt.Errorf("writing tar header for %q: %w", p, err)
+		}
+		if info.Mode().IsRegular() {
+			f, err := bc.fs.Open(p)
+			if err != nil {
+				return nil, nil, fmt.Errorf("opening %q: %w", p, err)
+			}
+			_, copyErr := io.Copy(tw, f)
+			f.Close()
+			if copyErr != nil {
+				return nil, nil, fmt.Errorf("copying %q into layer: %w", p, copyErr)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("closing tar writer: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("closing layer compressor: %w", err)
+	}
+
+	return diffid, digest, nil
+}
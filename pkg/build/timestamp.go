@@ -0,0 +1,88 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"path/filepath"
+	"time"
+
+	chainguardAPK "chainguard.dev/apko/pkg/apk"
+	"chainguard.dev/apko/pkg/options"
+)
+
+// fileModTimes builds a path -> mtime lookup from the installed-package DB
+// for use by options.TimestampPolicyPreserve. It returns nil without
+// touching the DB for any other policy, since resolveModTime never
+// consults it then.
+func (bc *Context) fileModTimes() (map[string]time.Time, error) {
+	if bc.o.TimestampPolicy != options.TimestampPolicyPreserve {
+		return nil, nil
+	}
+
+	installed, err := bc.apk.GetInstalled()
+	if err != nil {
+		return nil, err
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, pkg := range installed {
+		for _, f := range pkg.Files {
+			modTimes[filepath.Join("/", f.Name)] = f.ModTime
+		}
+	}
+	return modTimes, nil
+}
+
+// resolveModTime picks the mtime BuildTarball writes for path according to
+// bc.o.TimestampPolicy. modTimes is the lookup built by fileModTimes, and
+// is nil unless the policy is options.TimestampPolicyPreserve.
+func (bc *Context) resolveModTime(path string, modTimes map[string]time.Time) time.Time {
+	switch bc.o.TimestampPolicy {
+	case options.TimestampPolicyZero:
+		return time.Unix(0, 0)
+	case options.TimestampPolicyPreserve:
+		mtime, ok := modTimes[filepath.Join("/", path)]
+		if !ok {
+			return bc.o.SourceDateEpoch
+		}
+		if mtime.After(bc.o.SourceDateEpoch) {
+			bc.Logger().Debugf("clamping mtime of %s to SOURCE_DATE_EPOCH", path)
+			return bc.o.SourceDateEpoch
+		}
+		return mtime
+	default: // options.TimestampPolicySourceDateEpoch
+		return bc.o.SourceDateEpoch
+	}
+}
+
+// GetBuildDateEpoch returns the timestamp GenerateImageSBOM stamps onto
+// SBOM "created" fields, following bc.o.TimestampPolicy the same way
+// resolveModTime does for tar entry mtimes: options.TimestampPolicyZero
+// reports the UNIX epoch instead of SourceDateEpoch, so an SBOM diffed
+// across rebuilds under that policy doesn't churn on its creation time
+// either. GenerateIndexSBOM does not call it: index SBOMs are stamped with
+// bc.o.SourceDateEpoch under every policy.
+func (bc *Context) GetBuildDateEpoch() (time.Time, error) {
+	return buildDateEpoch(bc.o.TimestampPolicy, bc.o.SourceDateEpoch), nil
+}
+
+// buildDateEpoch is the policy decision behind GetBuildDateEpoch, pulled
+// out as a pure function so it can be unit tested without a *Context.
+func buildDateEpoch(policy options.TimestampPolicy, sourceDateEpoch time.Time) time.Time {
+	if policy == options.TimestampPolicyZero {
+		return time.Unix(0, 0)
+	}
+	return sourceDateEpoch
+}
@@ -0,0 +1,43 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	"chainguard.dev/apko/pkg/options"
+)
+
+func TestBuildDateEpoch(t *testing.T) {
+	sde := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		policy options.TimestampPolicy
+		want   time.Time
+	}{
+		{"source date epoch policy uses SOURCE_DATE_EPOCH", options.TimestampPolicySourceDateEpoch, sde},
+		{"zero policy uses the UNIX epoch", options.TimestampPolicyZero, time.Unix(0, 0)},
+		{"preserve policy falls back to SOURCE_DATE_EPOCH", options.TimestampPolicyPreserve, sde},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildDateEpoch(tt.policy, sde); !got.Equal(tt.want) {
+				t.Errorf("buildDateEpoch(%v) = %v, want %v", tt.policy, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package types holds the data model for an apko image configuration: the
+// packages to install, how the result should be laid out, and how it
+// should be tagged and described once built.
+package types
+
+import v1 "github.com/google/go-containerregistry/pkg/v1"
+
+// Architecture is a target CPU architecture, e.g. "amd64" or "arm64".
+type Architecture string
+
+// String returns the architecture as apko's image configuration spells
+// it (the Go/OCI platform name, e.g. "amd64").
+func (a Architecture) String() string {
+	return string(a)
+}
+
+// ToAPK returns the architecture as Alpine's apk tooling spells it (e.g.
+// "x86_64" for "amd64"), since packages are named and fetched using that
+// convention.
+func (a Architecture) ToAPK() string {
+	switch a {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7"
+	case "386":
+		return "x86"
+	default:
+		return string(a)
+	}
+}
+
+// Entrypoint describes how the built image starts up.
+type Entrypoint struct {
+	Type     string   `yaml:"type,omitempty"`
+	Command  string   `yaml:"command,omitempty"`
+	Services []string `yaml:"services,omitempty"`
+}
+
+// ImageConfiguration is the parsed form of an apko.yaml: everything
+// needed to resolve, install, and lay out a set of apk packages into an
+// image filesystem.
+type ImageConfiguration struct {
+	VCSUrl string `yaml:"vcs-url,omitempty"`
+
+	Entrypoint Entrypoint `yaml:"entrypoint,omitempty"`
+
+	// Layering partitions the built image's rootfs into multiple layers
+	// instead of BuildTarball's default single tarball. Leave Groups
+	// empty to keep the single-layer behavior.
+	Layering Layering `yaml:"layering,omitempty"`
+}
+
+// Layering configures how BuildTarball partitions an image's rootfs into
+// more than one layer.
+type Layering struct {
+	// Groups are tried in order for every installed file; whatever isn't
+	// claimed by any group falls into the implicit "top" group, which
+	// BuildTarball always emits last.
+	Groups []LayerGroup `yaml:"groups,omitempty"`
+}
+
+// LayerGroup names one layer BuildTarball produces and what ends up in
+// it: every file belonging to one of Packages, plus every file matching
+// one of Paths.
+type LayerGroup struct {
+	// Name identifies this group in the SBOM's package-to-layer
+	// relationships and in the generated tarball's file name.
+	Name string `yaml:"name"`
+	// Packages lists installed package names whose files belong in this
+	// group.
+	Packages []string `yaml:"packages,omitempty"`
+	// Paths lists filepath.Match globs, matched against the absolute
+	// path of every installed file not already claimed by Packages.
+	Paths []string `yaml:"paths,omitempty"`
+}
+
+// SBOM describes one generated SBOM file.
+type SBOM struct {
+	Path   string
+	Format string
+	Arch   string
+	Digest v1.Hash
+}
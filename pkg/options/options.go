@@ -0,0 +1,132 @@
+// Copyright 2022, 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package options holds the knobs that control a single apko build: where
+// its working files live, which SBOM formats to emit, and how the
+// resulting layer(s) are framed and compressed.
+package options
+
+import (
+	"time"
+
+	"chainguard.dev/apko/pkg/build/types"
+)
+
+// Logger is the subset of a structured logger that package build calls
+// through bc.Logger()/o.Logger().
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+// Options carries the configuration for a single-architecture apko build.
+type Options struct {
+	WorkDir     string
+	TempDirBase string
+	TarballPath string
+
+	SourceDateEpoch time.Time
+
+	SBOMPath    string
+	SBOMFormats []string
+
+	Arch types.Architecture
+	Tags []string
+
+	UseDockerMediaTypes bool
+
+	// LayerFormat selects the container format BuildTarball writes for
+	// image layers. The zero value is apko's original plain tar format,
+	// compressed per Compression; see build.LayerFormatEStargz for the
+	// opt-in eStargz value.
+	LayerFormat string
+
+	// TimestampPolicy selects the mtime BuildTarball writes for each tar
+	// entry. The zero value, TimestampPolicySourceDateEpoch, is apko's
+	// original, default behavior.
+	TimestampPolicy TimestampPolicy
+
+	// Compression selects the algorithm BuildTarball uses to compress a
+	// layer's tar stream. The zero value ("") behaves as CompressionGzip,
+	// apko's original, default behavior.
+	Compression Compression
+
+	Log Logger
+}
+
+// TimestampPolicy selects how BuildTarball chooses the mtime it writes
+// for each tar entry, mirroring the Shipwright pattern of giving callers a
+// choice between maximal reproducibility and preserving real history.
+type TimestampPolicy int
+
+const (
+	// TimestampPolicySourceDateEpoch clamps every entry's mtime to
+	// Options.SourceDateEpoch. This is apko's original, default
+	// behavior.
+	TimestampPolicySourceDateEpoch TimestampPolicy = iota
+	// TimestampPolicyZero ignores per-file mtimes entirely and writes the
+	// UNIX epoch (0) for every entry.
+	TimestampPolicyZero
+	// TimestampPolicyPreserve uses the file's own mtime as recorded in
+	// the installed-package DB, clamped to SourceDateEpoch as a ceiling
+	// so the build remains reproducible.
+	TimestampPolicyPreserve
+)
+
+// Compression selects the algorithm BuildTarball uses to compress a
+// layer's tar stream.
+type Compression string
+
+const (
+	// CompressionGzip is apko's original, default layer compression.
+	CompressionGzip Compression = "gzip"
+	// CompressionZstd compresses layers with zstd instead, which pulls
+	// and decompresses significantly faster on modern hardware.
+	CompressionZstd Compression = "zstd"
+	// CompressionNone writes an uncompressed tar.
+	CompressionNone Compression = "none"
+)
+
+// Logger returns the logger configured for this build, defaulting to a
+// no-op logger so callers never need a nil check.
+func (o Options) Logger() Logger {
+	if o.Log == nil {
+		return noopLogger{}
+	}
+	return o.Log
+}
+
+// TempDir returns the directory apko writes build artifacts (tarballs,
+// SBOMs, the index) into.
+func (o Options) TempDir() string {
+	if o.TempDirBase != "" {
+		return o.TempDirBase
+	}
+	return o.WorkDir
+}
+
+// TarballFileName returns the default layer tarball name for this build's
+// architecture, used when TarballPath is not set explicitly.
+func (o Options) TarballFileName() string {
+	return o.Arch.ToAPK() + ".tar.gz"
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Infof(string, ...interface{})  {}
+func (noopLogger) Warnf(string, ...interface{})  {}
+func (noopLogger) Errorf(string, ...interface{}) {}
+func (noopLogger) Debugf(string, ...interface{}) {}